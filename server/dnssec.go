@@ -5,12 +5,14 @@
 package server
 
 import (
+	"container/list"
 	"crypto/sha1"
 	"github.com/miekg/dns"
 	"github.com/skynetservices/skydns/msg"
 	"log"
 	"os"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -18,6 +20,12 @@ import (
 
 const origTTL uint32 = 60
 
+// Defaults used when a Server does not override them in its NSEC3 config.
+const (
+	nsec3DefaultAlgorithm  = dns.SHA1
+	nsec3DefaultIterations = 1
+)
+
 var cache *sigCache = newCache()
 var inflight *single = new(single)
 
@@ -30,6 +38,35 @@ var inflight *single = new(single)
 // So we treat it as 4 different zones.
 var denial *denialList = newDenialList()
 
+// nsec3 holds the same information as denial, but indexed by the
+// base32(hex)-encoded hash of the owner name instead of the plain name, so
+// that s.nsec can synthesize NSEC3 covering and matching records without
+// revealing the zone contents. It is only populated when a Server has NSEC3
+// enabled. nsec3mu guards the pointer itself: SetNSEC3 swaps it wholesale
+// when rehashing for new NSEC3 parameters, while readers may be looking it
+// up concurrently via nsec3List.
+var (
+	nsec3mu sync.RWMutex
+	nsec3   *denialList = newDenialList()
+)
+
+// nsec3List returns the denialList currently backing NSEC3 lookups,
+// synchronizing with SetNSEC3's wholesale swap of nsec3.
+func nsec3List() *denialList {
+	nsec3mu.RLock()
+	defer nsec3mu.RUnlock()
+	return nsec3
+}
+
+// nsec3Config returns the NSEC3 configuration currently in effect, or nil
+// when NSEC3 is disabled. Guarded by nsec3mu alongside nsec3, since
+// SetNSEC3 updates both together.
+func nsec3Config() *NSEC3Config {
+	nsec3mu.RLock()
+	defer nsec3mu.RUnlock()
+	return nsec3cfg
+}
+
 // ParseKeyFile read a DNSSEC keyfile as generated by dnssec-keygen or other
 // utilities. It add ".key" for the public key and ".private" for the private key.
 func ParseKeyFile(file string) (*dns.DNSKEY, dns.PrivateKey, error) {
@@ -52,15 +89,38 @@ func ParseKeyFile(file string) (*dns.DNSKEY, dns.PrivateKey, error) {
 	return k.(*dns.DNSKEY), p, nil
 }
 
-// nsec creates (if needed) NSEC records that are included in the
-// reply.
+// nsec creates (if needed) NSEC or NSEC3 records that are included in the
+// reply. Which one is used depends on whether NSEC3 is enabled for s.
 func (s *Server) nsec(m *dns.Msg) {
+	if s.NSEC3 != nil {
+		s.nsec3(m)
+		return
+	}
 	if m.Rcode == dns.RcodeNameError {
 		m.Ns = append(m.Ns, s.newNSEC(m.Question[0].Name))
+		nsecSynthesized.Inc()
 	}
 	if m.Rcode == dns.RcodeSuccess && len(m.Ns) == 1 {
 		if _, ok := m.Ns[0].(*dns.SOA); ok {
 			m.Ns = append(m.Ns, s.newNSEC(m.Question[0].Name))
+			nsecSynthesized.Inc()
+		}
+	}
+}
+
+// nsec3 is the NSEC3 counterpart of nsec. For NXDOMAIN it adds a covering
+// NSEC3; for NODATA it adds the matching NSEC3. Wildcard synthesis is left
+// to newNSEC3Wildcard, which is called from the place that detects a
+// wildcard match.
+func (s *Server) nsec3(m *dns.Msg) {
+	if m.Rcode == dns.RcodeNameError {
+		m.Ns = append(m.Ns, s.newNSEC3(m.Question[0].Name, false))
+		nsec3Synthesized.Inc()
+	}
+	if m.Rcode == dns.RcodeSuccess && len(m.Ns) == 1 {
+		if _, ok := m.Ns[0].(*dns.SOA); ok {
+			m.Ns = append(m.Ns, s.newNSEC3(m.Question[0].Name, true))
+			nsec3Synthesized.Inc()
 		}
 	}
 }
@@ -78,43 +138,51 @@ func (s *Server) sign(m *dns.Msg, bufsize uint16) {
 
 	// TODO(miek): repeating this two times?
 	for _, r := range rrSets(m.Answer) {
-		key := cache.key(r)
-		if s := cache.search(key); s != nil {
-			if s.ValidityPeriod(now.Add(-24 * time.Hour)) {
-				m.Answer = append(m.Answer, s)
-				continue
-			}
-			cache.remove(key)
-		}
-		sig, err, shared := inflight.Do(key, func() (*dns.RRSIG, error) {
-			sig1 := s.newRRSIG(incep, expir)
-			e := sig1.Sign(s.Privkey, r)
-			if e != nil {
-				log.Printf("Failed to sign: %s\n", e.Error())
-			}
-			return sig1, e
-		})
-		if err != nil {
-			continue
-		}
-		if !shared {
-			// is it possible to miss this, due the the c.dups > 0 in Do()? TODO(miek)
-			cache.insert(key, sig)
-		}
-		m.Answer = append(m.Answer, dns.Copy(sig).(*dns.RRSIG))
+		m.Answer = append(m.Answer, s.signRRset(r, now, incep, expir)...)
 	}
 	for _, r := range rrSets(m.Ns) {
-		key := cache.key(r)
-		if s := cache.search(key); s != nil {
-			if s.ValidityPeriod(now.Add(-24 * time.Hour)) {
-				m.Ns = append(m.Ns, s)
+		m.Ns = append(m.Ns, s.signRRset(r, now, incep, expir)...)
+	}
+	// TODO(miek): Forget the additional section for now
+	if bufsize >= 512 || bufsize <= 4096 {
+		m.Truncated = m.Len() > int(bufsize)
+	}
+	o := new(dns.OPT)
+	o.Hdr.Name = "."
+	o.Hdr.Rrtype = dns.TypeOPT
+	o.SetDo()
+	o.SetUDPSize(4096)
+	m.Extra = append(m.Extra, o)
+	return
+}
+
+// signRRset returns the RRSIGs covering r, signed by every active ZSK whose
+// algorithm is present in the DNSKEY RRset, plus (when r is a DNSKEY RRset)
+// every active KSK. Signatures are served from the cache when available.
+func (s *Server) signRRset(r []dns.RR, now time.Time, incep, expir uint32) []dns.RR {
+	keys := s.zskSigningSet()
+	if r[0].Header().Rrtype == dns.TypeDNSKEY {
+		keys = append(keys, s.Keys.KSKs()...)
+	}
+
+	sigs := make([]dns.RR, 0, len(keys))
+	rrtype := dns.TypeToString[r[0].Header().Rrtype]
+	for _, k := range keys {
+		cachekey := cache.key(r, k.Tag)
+		if sig := cache.search(cachekey); sig != nil {
+			sigCacheHit.WithLabelValues(rrtype).Inc()
+			if sig.ValidityPeriod(now.Add(-24 * time.Hour)) {
+				sigs = append(sigs, sig)
 				continue
 			}
-			cache.remove(key)
+			cache.remove(cachekey)
+		} else {
+			sigCacheMiss.WithLabelValues(rrtype).Inc()
 		}
-		sig, err, shared := inflight.Do(key, func() (*dns.RRSIG, error) {
-			sig1 := s.newRRSIG(incep, expir)
-			e := sig1.Sign(s.Privkey, r)
+		start := time.Now()
+		sig, err, shared := inflight.Do(cachekey, func() (*dns.RRSIG, error) {
+			sig1 := newRRSIG(k, incep, expir)
+			e := sig1.Sign(k.Privkey, r)
 			if e != nil {
 				log.Printf("Failed to sign: %s\n", e.Error())
 			}
@@ -123,35 +191,45 @@ func (s *Server) sign(m *dns.Msg, bufsize uint16) {
 		if err != nil {
 			continue
 		}
-		if !shared {
+		if shared {
+			sigInflightDup.Inc()
+		} else {
 			// is it possible to miss this, due the the c.dups > 0 in Do()? TODO(miek)
-			cache.insert(key, sig)
+			cache.insert(cachekey, sig, r, k.Tag)
+			signLatency.Observe(time.Since(start).Seconds())
 		}
-		m.Ns = append(m.Ns, dns.Copy(sig).(*dns.RRSIG))
+		sigs = append(sigs, dns.Copy(sig).(*dns.RRSIG))
 	}
-	// TODO(miek): Forget the additional section for now
-	if bufsize >= 512 || bufsize <= 4096 {
-		m.Truncated = m.Len() > int(bufsize)
+	return sigs
+}
+
+// zskSigningSet returns the active ZSKs an RRset must be signed with: every
+// active ZSK whose algorithm is present in the zone's DNSKEY RRset, so while
+// an old and a new ZSK are both active they both sign (double-signature
+// rollover).
+func (s *Server) zskSigningSet() []*Key {
+	algos := s.Keys.Algorithms()
+	zsks := s.Keys.ZSKs()
+	keys := make([]*Key, 0, len(zsks))
+	for _, k := range zsks {
+		if !algos[k.Dnskey.Algorithm] {
+			continue
+		}
+		keys = append(keys, k)
 	}
-	o := new(dns.OPT)
-	o.Hdr.Name = "."
-	o.Hdr.Rrtype = dns.TypeOPT
-	o.SetDo()
-	o.SetUDPSize(4096)
-	m.Extra = append(m.Extra, o)
-	return
+	return keys
 }
 
-func (s *Server) newRRSIG(incep, expir uint32) *dns.RRSIG {
+func newRRSIG(k *Key, incep, expir uint32) *dns.RRSIG {
 	sig := new(dns.RRSIG)
 	sig.Hdr.Rrtype = dns.TypeRRSIG
 	sig.Hdr.Ttl = origTTL
 	sig.OrigTtl = origTTL
-	sig.Algorithm = s.Dnskey.Algorithm
-	sig.KeyTag = s.KeyTag
+	sig.Algorithm = k.Dnskey.Algorithm
+	sig.KeyTag = k.Tag
 	sig.Inception = incep
 	sig.Expiration = expir
-	sig.SignerName = s.Dnskey.Hdr.Name
+	sig.SignerName = k.Dnskey.Hdr.Name
 	return sig
 }
 
@@ -169,19 +247,187 @@ func (s *Server) newNSEC(qname string) *dns.NSEC {
 	if ls4 < 0 {
 		ls4 = 0
 	}
-	key := qlabels[ls4:ls]
+	joined := strings.Join(qlabels[ls4:ls], ".")
 	// SOA has different types then the rest
-	prev, next := denial.search(strings.Join(key, "."), len(key))
+	prev, next := denial.search(joined, ls-ls4)
 	nsec := &dns.NSEC{Hdr: dns.RR_Header{Name: prev + s.domain + ".", Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 60},
 		NextDomain: next + s.domain + "."}
 	if prev == "" {
 		nsec.TypeBitMap = []uint16{dns.TypeSOA, dns.TypeNS, dns.TypeRRSIG, dns.TypeDNSKEY, dns.TypeNSEC}
 	} else {
 		nsec.TypeBitMap = []uint16{dns.TypeA, dns.TypeAAAA, dns.TypeSRV, dns.TypeNSEC}
+		if denial.hasTLSA(joined, ls-ls4) {
+			nsec.TypeBitMap = append(nsec.TypeBitMap, dns.TypeTLSA)
+		}
 	}
 	return nsec
 }
 
+// NSEC3Config holds the parameters used to hash owner names for NSEC3
+// authenticated denial-of-existence (RFC 5155). A Server with a nil NSEC3
+// falls back to plain NSEC.
+type NSEC3Config struct {
+	Algorithm  uint8  // hash algorithm, currently only dns.SHA1 is defined
+	Iterations uint16 // additional hash iterations, see RFC 5155 section 5
+	Salt       string // hex encoded salt, "" for no salt
+	OptOut     bool   // set the opt-out flag on generated NSEC3 records
+}
+
+// newNSEC3Config returns a NSEC3Config with skydns's defaults: SHA1, a
+// single iteration and no salt.
+func newNSEC3Config() *NSEC3Config {
+	return &NSEC3Config{Algorithm: nsec3DefaultAlgorithm, Iterations: nsec3DefaultIterations}
+}
+
+// hash returns the base32(hex)-encoded NSEC3 hash for name, using c's
+// algorithm, iterations and salt, as specified in RFC 5155 section 5.
+func (c *NSEC3Config) hash(name string) string {
+	return dns.HashName(name, c.Algorithm, c.Iterations, c.Salt)
+}
+
+// soa returns the zone's SOA record, for the authority section of negative
+// replies that don't otherwise go through the normal query path (see
+// ServeDNSTLSA).
+func (s *Server) soa() *dns.SOA {
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: s.domain + ".", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: origTTL},
+		Ns:      "ns.dns." + s.domain + ".",
+		Mbox:    "hostmaster.dns." + s.domain + ".",
+		Serial:  uint32(time.Now().Unix()),
+		Refresh: 28800,
+		Retry:   7200,
+		Expire:  604800,
+		Minttl:  origTTL,
+	}
+}
+
+// nsec3param returns the NSEC3PARAM record served at the zone apex for s.
+func (s *Server) nsec3param() *dns.NSEC3PARAM {
+	return &dns.NSEC3PARAM{
+		Hdr:        dns.RR_Header{Name: s.domain + ".", Rrtype: dns.TypeNSEC3PARAM, Class: dns.ClassINET, Ttl: origTTL},
+		Hash:       s.NSEC3.Algorithm,
+		Flags:      0,
+		Iterations: s.NSEC3.Iterations,
+		SaltLength: uint8(len(s.NSEC3.Salt) / 2),
+		Salt:       s.NSEC3.Salt,
+	}
+}
+
+// newNSEC3 returns the NSEC3 record needed to deny qname (nodata selects a
+// matching NSEC3 for a NODATA response instead of a covering one for
+// NXDOMAIN).
+func (s *Server) newNSEC3(qname string, nodata bool) *dns.NSEC3 {
+	qlabels := dns.SplitDomainName(qname)
+	ls := len(qlabels) - s.domainLabels
+	ls4 := ls - 4
+	if ls4 < 0 {
+		ls4 = 0
+	}
+	key := strings.Join(qlabels[ls4:ls], ".")
+	l := ls - ls4
+	if l == 0 {
+		l = 1
+	}
+
+	h := s.NSEC3.hash(key)
+	list := nsec3List()
+	prev, next := list.search(h, l)
+	owner := prev
+	if nodata {
+		// h itself is the owner here, so its successor - not h - is what
+		// NextDomain must cover; search returns h as "next" when h is
+		// present, which would otherwise make the record point at itself.
+		owner = h
+		next = list.matchingNext(h, l)
+	}
+
+	nsec3rr := &dns.NSEC3{
+		Hdr:        dns.RR_Header{Name: owner + "." + s.domain + ".", Rrtype: dns.TypeNSEC3, Class: dns.ClassINET, Ttl: origTTL},
+		Hash:       s.NSEC3.Algorithm,
+		Iterations: s.NSEC3.Iterations,
+		SaltLength: uint8(len(s.NSEC3.Salt) / 2),
+		Salt:       s.NSEC3.Salt,
+		NextDomain: next,
+	}
+	if s.NSEC3.OptOut {
+		nsec3rr.Flags = 1
+	}
+	if nodata && key == "" {
+		nsec3rr.TypeBitMap = []uint16{dns.TypeSOA, dns.TypeNS, dns.TypeRRSIG, dns.TypeDNSKEY, dns.TypeNSEC3PARAM}
+	} else {
+		nsec3rr.TypeBitMap = []uint16{dns.TypeA, dns.TypeAAAA, dns.TypeSRV, dns.TypeRRSIG}
+		if denial.hasTLSA(key, l) {
+			nsec3rr.TypeBitMap = append(nsec3rr.TypeBitMap, dns.TypeTLSA)
+		}
+	}
+	return nsec3rr
+}
+
+// closestEncloser finds qname's closest encloser: the longest ancestor of
+// qname (within the 4 labels the denial lists track) that names a
+// registered service. It also returns that ancestor's label depth and the
+// "next closer" name, the one label of qname longer than the closest
+// encloser, whose non-existence the closest-encloser proof must also cover
+// (RFC 5155 section 7.2.1).
+func (s *Server) closestEncloser(qname string) (closest string, depth int, nextCloser string) {
+	qlabels := dns.SplitDomainName(qname)
+	ls := len(qlabels) - s.domainLabels
+	ls4 := ls - 4
+	if ls4 < 0 {
+		ls4 = 0
+	}
+	labels := qlabels[ls4:ls]
+	for d := len(labels) - 1; d >= 1; d-- {
+		suffix := strings.Join(labels[len(labels)-d:], ".")
+		if denial.exists(suffix, d) {
+			return suffix, d, strings.Join(labels[len(labels)-d-1:], ".")
+		}
+	}
+	next := ""
+	if len(labels) > 0 {
+		next = labels[len(labels)-1]
+	}
+	return "", 0, next
+}
+
+// newNSEC3Wildcard returns the three NSEC3 records that make up a closest
+// encloser proof for a wildcard match on qname: the NSEC3 matching the
+// closest encloser, the NSEC3 covering the next closer name, and the NSEC3
+// covering the wildcard itself (RFC 5155 section 7.2.6).
+func (s *Server) newNSEC3Wildcard(qname string) []dns.RR {
+	closest, _, nextCloser := s.closestEncloser(qname)
+	apex := s.domain + "."
+
+	encloserName := apex
+	if closest != "" {
+		encloserName = closest + "." + apex
+	}
+	nextCloserName := apex
+	if nextCloser != "" {
+		nextCloserName = nextCloser + "." + apex
+	}
+	wildcardName := "*." + apex
+	if closest != "" {
+		wildcardName = "*." + closest + "." + apex
+	}
+
+	match := s.newNSEC3(encloserName, true)
+	cover := s.newNSEC3(nextCloserName, false)
+	wildcard := s.newNSEC3(wildcardName, false)
+	return []dns.RR{match, cover, wildcard}
+}
+
+// nsec3Wildcard appends the closest-encloser proof to m.Ns for a reply that
+// was synthesized from a wildcard match on qname, instead of the plain
+// matching/covering NSEC3 that nsec3 adds for an exact owner name. The
+// query handler calls this in place of nsec3 whenever it detects that the
+// answer it built came from a "*" owner.
+func (s *Server) nsec3Wildcard(m *dns.Msg, qname string) {
+	proof := s.newNSEC3Wildcard(qname)
+	m.Ns = append(m.Ns, proof...)
+	nsec3Synthesized.Add(float64(len(proof)))
+}
+
 type rrset struct {
 	qname  string
 	qclass uint16
@@ -205,48 +451,162 @@ func rrSets(rrs []dns.RR) map[rrset][]dns.RR {
 	return nil
 }
 
+// defaultSigCacheCapacity bounds the number of signatures sigCache holds
+// before it starts evicting the least recently used entry, so a runaway
+// number of distinct RRsets can't grow the cache without bound.
+const defaultSigCacheCapacity = 50000
+
+// sigCacheEntry is what sigCache actually stores: the signature plus enough
+// to redo the signing operation later, so the background refresher doesn't
+// need to re-derive the RRset from the (one-way) cache key.
+type sigCacheEntry struct {
+	sig      *dns.RRSIG
+	rrset    []dns.RR
+	keyTag   uint16
+	cacheKey string
+}
+
+// sigCache is an LRU cache of RRSIGs, keyed by sigCache.key. Capacity limits
+// the resident set; search promotes an entry to most-recently-used.
 type sigCache struct {
 	sync.RWMutex
-	m map[string]*dns.RRSIG
+	m        map[string]*list.Element // key -> element of lru, holding *sigCacheEntry
+	lru      *list.List
+	capacity int
 }
 
 func newCache() *sigCache {
 	c := new(sigCache)
-	c.m = make(map[string]*dns.RRSIG)
+	c.m = make(map[string]*list.Element)
+	c.lru = list.New()
+	c.capacity = defaultSigCacheCapacity
 	return c
 }
 
+// SetCapacity changes the maximum number of signatures c holds, evicting
+// the least recently used entries if the cache is currently over the new
+// limit.
+func (c *sigCache) SetCapacity(n int) {
+	c.Lock()
+	defer c.Unlock()
+	c.capacity = n
+	for c.lru.Len() > c.capacity {
+		c.evictOldest()
+		sigCacheEvictions.Inc()
+	}
+	sigCacheSize.Set(float64(c.lru.Len()))
+}
+
+// evictOldest removes the least recently used entry. The caller must hold c's lock.
+func (c *sigCache) evictOldest() {
+	e := c.lru.Back()
+	if e == nil {
+		return
+	}
+	c.lru.Remove(e)
+	delete(c.m, e.Value.(*sigCacheEntry).cacheKey)
+}
+
 func (c *sigCache) remove(s string) {
-	delete(c.m, s)
+	c.Lock()
+	defer c.Unlock()
+	if e, ok := c.m[s]; ok {
+		c.lru.Remove(e)
+		delete(c.m, s)
+	}
+	sigCacheSize.Set(float64(c.lru.Len()))
 }
 
-func (c *sigCache) insert(s string, r *dns.RRSIG) {
+// insert adds or replaces the cached signature for s. Unlike the previous
+// "insert if absent" behaviour, a fresh signature always replaces a stale
+// one still present under the same key, since insert is only ever called
+// right after (re)signing.
+func (c *sigCache) insert(s string, r *dns.RRSIG, rrset []dns.RR, keyTag uint16) {
 	c.Lock()
 	defer c.Unlock()
-	if _, ok := c.m[s]; !ok {
-		c.m[s] = r
+	entry := &sigCacheEntry{sig: r, rrset: rrset, keyTag: keyTag, cacheKey: s}
+	if e, ok := c.m[s]; ok {
+		e.Value = entry
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.m[s] = c.lru.PushFront(entry)
+	if c.lru.Len() > c.capacity {
+		c.evictOldest()
+		sigCacheEvictions.Inc()
 	}
+	sigCacheSize.Set(float64(c.lru.Len()))
 }
 
 func (c *sigCache) search(s string) *dns.RRSIG {
-	c.RLock()
-	defer c.RUnlock()
-	if s, ok := c.m[s]; ok {
+	c.Lock()
+	defer c.Unlock()
+	if e, ok := c.m[s]; ok {
+		c.lru.MoveToFront(e)
 		// we want to return a copy here, because if we didn't the RRSIG
 		// could be removed by another goroutine before the packet containing
 		// this signature is send out.
-		log.Println("DNS Signature retrieved from cache")
-		return dns.Copy(s).(*dns.RRSIG)
+		return dns.Copy(e.Value.(*sigCacheEntry).sig).(*dns.RRSIG)
 	}
 	return nil
 }
 
-// key uses the name, type and rdata, which is serialized and then hashed as the
-// key for the lookup
-func (c *sigCache) key(rrs []dns.RR) string {
+// expiring returns a snapshot of cache entries whose RRSIG expires before
+// deadline, for the background refresher to re-sign.
+func (c *sigCache) expiring(deadline uint32) []*sigCacheEntry {
+	c.RLock()
+	defer c.RUnlock()
+	due := make([]*sigCacheEntry, 0)
+	for e := c.lru.Front(); e != nil; e = e.Next() {
+		entry := e.Value.(*sigCacheEntry)
+		if entry.sig.Expiration < deadline {
+			due = append(due, entry)
+		}
+	}
+	return due
+}
+
+// refreshWindow is how far ahead of a signature's expiration the background
+// refresher re-signs it, so query-time never blocks on an expiring RRSIG.
+const refreshWindow = 24 * time.Hour
+
+// refresh periodically re-signs cache entries that are about to expire. It
+// is meant to be run in its own goroutine for the lifetime of the server.
+func (s *Server) refresh(interval time.Duration) {
+	for range time.Tick(interval) {
+		deadline := uint32(time.Now().UTC().Add(refreshWindow).Unix())
+		for _, entry := range cache.expiring(deadline) {
+			k := s.Keys.ByTag(entry.keyTag)
+			if k == nil {
+				continue
+			}
+			now := time.Now().UTC()
+			incep := uint32(now.Add(-2 * time.Hour).Unix())
+			expir := uint32(now.Add(7 * 24 * time.Hour).Unix())
+			sig, err, _ := inflight.Do(entry.cacheKey, func() (*dns.RRSIG, error) {
+				sig1 := newRRSIG(k, incep, expir)
+				e := sig1.Sign(k.Privkey, entry.rrset)
+				return sig1, e
+			})
+			if err != nil {
+				log.Printf("Failed to refresh signature: %s\n", err.Error())
+				continue
+			}
+			cache.insert(entry.cacheKey, sig, entry.rrset, entry.keyTag)
+			sigCacheRefreshes.Inc()
+		}
+	}
+}
+
+// key uses the name, type, rdata and signing key tag, which is serialized
+// and then hashed as the key for the lookup. The key tag must be part of
+// the cache key, otherwise a signature made with a key that has since been
+// retired from the ring could still be served from the cache.
+func (c *sigCache) key(rrs []dns.RR, tag uint16) string {
 	h := sha1.New()
 	i := []byte(rrs[0].Header().Name)
 	i = append(i, packUint16(rrs[0].Header().Rrtype)...)
+	i = append(i, packUint16(tag)...)
 	for _, r := range rrs {
 		switch t := r.(type) { // we only do a few type, serialize these manually
 		case *dns.SOA:
@@ -265,6 +625,9 @@ func (c *sigCache) key(rrs []dns.RR) string {
 			// Need nothing more, the rdata stays the same during a run
 		case *dns.NSEC:
 			// nextname?
+		case *dns.TLSA:
+			i = append(i, t.Usage, t.Selector, t.MatchingType)
+			i = append(i, []byte(t.Certificate)...)
 		default:
 			// not handled
 		}
@@ -318,6 +681,7 @@ func (g *single) Do(key string, fn func() (*dns.RRSIG, error)) (*dns.RRSIG, erro
 type denialref struct {
 	name      string // domain name
 	reference int    // reference count
+	tlsa      int    // number of registrations under name that publish a TLSA record
 }
 
 type denialList struct {
@@ -340,45 +704,126 @@ func newDenialList() *denialList {
 }
 
 // insert increments the reference of a name, if the name is new it will also
-// be inserted.
-func (d *denialList) insert(x string, l int) {
+// be inserted. tlsa marks whether this registration publishes a TLSA record
+// under name, so newNSEC/newNSEC3 can add TypeTLSA to the type bitmap.
+func (d *denialList) insert(x string, l int, tlsa bool) {
 	d.m.Lock()
 	defer d.m.Unlock()
 	i := sort.Search(len(d.list[l-1]), func(i int) bool { return d.list[l-1][i].name >= x })
 	if i < len(d.list[l-1]) && d.list[l-1][i].name == x {
 		d.list[l-1][i].reference++
+		if tlsa {
+			d.list[l-1][i].tlsa++
+		}
 		return
 	}
-	d.list[l-1] = append(d.list[l-1], denialref{"", 0})
+	d.list[l-1] = append(d.list[l-1], denialref{})
 	copy(d.list[l-1][i+1:], d.list[l-1][i:])
 
 	d.list[l-1][i].name = x
 	d.list[l-1][i].reference = 1
+	if tlsa {
+		d.list[l-1][i].tlsa = 1
+	}
 
+	denialListSize.WithLabelValues(strconv.Itoa(l)).Set(float64(len(d.list[l-1])))
 	return
 }
 
+// hasTLSA reports whether the exact name x at label depth l currently has a
+// registration publishing a TLSA record.
+func (d *denialList) hasTLSA(x string, l int) bool {
+	d.m.RLock()
+	defer d.m.RUnlock()
+	i := sort.Search(len(d.list[l-1]), func(i int) bool { return d.list[l-1][i].name >= x })
+	return i < len(d.list[l-1]) && d.list[l-1][i].name == x && d.list[l-1][i].tlsa > 0
+}
+
+// exists reports whether the exact name x is currently tracked at label
+// depth l, i.e. whether x names a registered service (or an ancestor of
+// one), as opposed to merely falling between two tracked names.
+func (d *denialList) exists(x string, l int) bool {
+	d.m.RLock()
+	defer d.m.RUnlock()
+	i := sort.Search(len(d.list[l-1]), func(i int) bool { return d.list[l-1][i].name >= x })
+	return i < len(d.list[l-1]) && d.list[l-1][i].name == x
+}
+
 func addServiceNSEC(s msg.Service) {
 	// TODO(miek): replace host and version . for -
 	log.Printf("Adding NSEC for Service")
-	denial.insert(s.Region+"."+s.Version+"."+s.Name+"."+s.Environment, 4)
-	denial.insert(s.Version+"."+s.Name+"."+s.Environment, 3)
-	denial.insert(s.Name+"."+s.Environment, 2)
-	denial.insert(s.Environment, 1)
+	tlsa := s.TLSA != nil
+	denial.insert(s.Region+"."+s.Version+"."+s.Name+"."+s.Environment, 4, tlsa)
+	denial.insert(s.Version+"."+s.Name+"."+s.Environment, 3, tlsa)
+	denial.insert(s.Name+"."+s.Environment, 2, tlsa)
+	denial.insert(s.Environment, 1, tlsa)
+
+	cfg := nsec3Config()
+	if cfg == nil {
+		return
+	}
+	list := nsec3List()
+	list.insert(cfg.hash(s.Region+"."+s.Version+"."+s.Name+"."+s.Environment), 4, tlsa)
+	list.insert(cfg.hash(s.Version+"."+s.Name+"."+s.Environment), 3, tlsa)
+	list.insert(cfg.hash(s.Name+"."+s.Environment), 2, tlsa)
+	list.insert(cfg.hash(s.Environment), 1, tlsa)
+}
+
+// nsec3cfg is the NSEC3 configuration of the server that owns this process'
+// denial subsystem, or nil when NSEC3 is disabled and plain NSEC is served
+// instead. Server.SetNSEC3 keeps it and nsec3 (the hashed denial list) in
+// sync with the running configuration; both are read through nsec3Config
+// and nsec3List, which share nsec3mu, since a service (de)registration can
+// run concurrently with a reconfiguration.
+var nsec3cfg *NSEC3Config
+
+// SetNSEC3 enables NSEC3 for s using c, rehashing every name currently
+// tracked by the (plaintext) denial list so NSEC3 responses are available
+// immediately. A nil c disables NSEC3 again.
+func (s *Server) SetNSEC3(c *NSEC3Config) {
+	s.NSEC3 = c
+	if c == nil {
+		nsec3mu.Lock()
+		nsec3cfg = nil
+		nsec3mu.Unlock()
+		return
+	}
+	rebuilt := newDenialList()
+	denial.m.RLock()
+	for l := 1; l <= 4; l++ {
+		for _, ref := range denial.list[l-1] {
+			if ref.name == "" {
+				continue
+			}
+			for i := 0; i < ref.reference; i++ {
+				rebuilt.insert(c.hash(ref.name), l, i < ref.tlsa)
+			}
+		}
+	}
+	denial.m.RUnlock()
+
+	nsec3mu.Lock()
+	nsec3cfg = c
+	nsec3 = rebuilt
+	nsec3mu.Unlock()
 }
 
 // remove decrements the reference of a name, if the reference hits zero
 // the name is removed.
-func (d *denialList) remove(x string, l int) {
+func (d *denialList) remove(x string, l int, tlsa bool) {
 	d.m.Lock()
 	defer d.m.Unlock()
 	i := sort.Search(len(d.list[l-1]), func(i int) bool { return d.list[l-1][i].name >= x })
 	if i < len(d.list[l-1]) && d.list[l-1][i].name == x {
 		d.list[l-1][i].reference--
+		if tlsa && d.list[l-1][i].tlsa > 0 {
+			d.list[l-1][i].tlsa--
+		}
 		if d.list[l-1][i].reference == 0 {
 			copy(d.list[l-1][i:], d.list[l-1][i+1:])
-			d.list[l-1][len(d.list[l-1])-1] = denialref{"", 0}
+			d.list[l-1][len(d.list[l-1])-1] = denialref{}
 			d.list[l-1] = d.list[l-1][:len(d.list[l-1])-1]
+			denialListSize.WithLabelValues(strconv.Itoa(l)).Set(float64(len(d.list[l-1])))
 		}
 	}
 	return
@@ -386,22 +831,59 @@ func (d *denialList) remove(x string, l int) {
 
 func removeServiceNSEC(s msg.Service) {
 	log.Printf("Removing NSEC for Service")
-	denial.insert(s.Region+"."+s.Version+"."+s.Name+"."+s.Environment, 4)
-	denial.insert(s.Version+"."+s.Name+"."+s.Environment, 3)
-	denial.insert(s.Name+"."+s.Environment, 2)
-	denial.insert(s.Environment, 1)
+	tlsa := s.TLSA != nil
+	denial.remove(s.Region+"."+s.Version+"."+s.Name+"."+s.Environment, 4, tlsa)
+	denial.remove(s.Version+"."+s.Name+"."+s.Environment, 3, tlsa)
+	denial.remove(s.Name+"."+s.Environment, 2, tlsa)
+	denial.remove(s.Environment, 1, tlsa)
+
+	cfg := nsec3Config()
+	if cfg == nil {
+		return
+	}
+	list := nsec3List()
+	list.remove(cfg.hash(s.Region+"."+s.Version+"."+s.Name+"."+s.Environment), 4, tlsa)
+	list.remove(cfg.hash(s.Version+"."+s.Name+"."+s.Environment), 3, tlsa)
+	list.remove(cfg.hash(s.Name+"."+s.Environment), 2, tlsa)
+	list.remove(cfg.hash(s.Environment), 1, tlsa)
 }
 
-// search searches the denial list for name, if found we return it, and create
-// a nodata nsec response by filling the types. If not found we get back an index
-// we return the string before and after that one.
+// search searches the denial list for name, and returns the name
+// immediately before it in sorted order and the first name not before it
+// (x itself when x is present), so the caller can synthesize a covering
+// NSEC/NSEC3. Either return can be "" when x sorts before the first entry
+// or after the last one (including when the list at depth l is empty).
 func (d *denialList) search(x string, l int) (string, string) {
 	d.m.RLock()
 	defer d.m.RUnlock()
-	i := sort.Search(len(d.list[l-1]), func(i int) bool { return d.list[l-1][i].name >= x })
-	// TODO(need, not found, nil
-	if i == 1 {
-		return "", d.list[l-1][i].name
+	n := len(d.list[l-1])
+	i := sort.Search(n, func(i int) bool { return d.list[l-1][i].name >= x })
+
+	prev, next := "", ""
+	if i > 0 {
+		prev = d.list[l-1][i-1].name
+	}
+	if i < n {
+		next = d.list[l-1][i].name
+	}
+	return prev, next
+}
+
+// matchingNext returns the name that follows x in the sorted list at depth
+// l, for the case where x is known to already exist there (a NODATA/matching
+// NSEC3 response). Unlike search, which treats x as its own successor when
+// x is present, this returns the name after it; the list wraps, so the
+// successor of the last entry is the first one.
+func (d *denialList) matchingNext(x string, l int) string {
+	d.m.RLock()
+	defer d.m.RUnlock()
+	n := len(d.list[l-1])
+	i := sort.Search(n, func(i int) bool { return d.list[l-1][i].name >= x })
+	if i >= n || d.list[l-1][i].name != x {
+		return ""
+	}
+	if i+1 == n {
+		return d.list[l-1][0].name
 	}
-	return d.list[l-1][i-1].name, d.list[l-1][i].name
+	return d.list[l-1][i+1].name
 }
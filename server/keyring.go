@@ -0,0 +1,235 @@
+// Copyright (c) 2013 Erik St. Martin, Brian Ketelsen. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"encoding/json"
+	"github.com/miekg/dns"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// KeyRole distinguishes a key signing key from a zone signing key.
+type KeyRole int
+
+const (
+	ZSK KeyRole = iota
+	KSK
+)
+
+// KeyState is a key's position in the publish/active/retire rollover
+// life cycle, driven by the timestamps in the KeyRing's sidecar state file.
+type KeyState int
+
+const (
+	Published KeyState = iota
+	Active
+	Retired
+)
+
+// Key is a single DNSKEY/private key pair known to a KeyRing, together with
+// its role and its current place in the rollover state machine.
+type Key struct {
+	Dnskey  *dns.DNSKEY
+	Privkey dns.PrivateKey
+	Tag     uint16
+	Role    KeyRole
+	State   KeyState
+
+	PublishedAt time.Time
+	ActiveAt    time.Time
+	RetiredAt   time.Time
+}
+
+// KeyRing holds every key skydns knows about for a zone, so sign can sign
+// each RRset with every active ZSK and DNSKEY
+// RRsets with the active KSKs as well, while a new key is staged alongside
+// the old one during a rollover.
+type KeyRing struct {
+	mu   sync.RWMutex
+	keys []*Key
+}
+
+// NewKeyRing returns an empty KeyRing.
+func NewKeyRing() *KeyRing { return new(KeyRing) }
+
+// rolloverState is the on-disk representation of a Key's place in the
+// publish/active/retire state machine, keyed by key tag, so operators can
+// stage a rollover without having to restart skydns at each transition.
+type rolloverState struct {
+	PublishedAt time.Time `json:"published_at"`
+	ActiveAt    time.Time `json:"active_at"`
+	RetiredAt   time.Time `json:"retired_at"`
+}
+
+// LoadKeyDir parses every K*.key/K*.private pair in dir, determining each
+// key's role from the SEP (KSK) bit in the DNSKEY flags and computing its
+// key tag. Rollover timestamps are read from the sidecar file
+// "rollover.json" in dir, if present; a key with no entry there is
+// considered Active from the moment it is loaded.
+func (k *KeyRing) LoadKeyDir(dir string) error {
+	states, err := loadRolloverStates(filepath.Join(dir, "rollover.json"))
+	if err != nil {
+		return err
+	}
+
+	matches, err := filepath.Glob(filepath.Join(dir, "K*.key"))
+	if err != nil {
+		return err
+	}
+
+	keys := make([]*Key, 0, len(matches))
+	for _, m := range matches {
+		base := strings.TrimSuffix(m, ".key")
+		dnskey, privkey, err := ParseKeyFile(base)
+		if err != nil {
+			return err
+		}
+		key := &Key{
+			Dnskey:  dnskey,
+			Privkey: privkey,
+			Tag:     dnskey.KeyTag(),
+			Role:    ZSK,
+			State:   Active,
+		}
+		if dnskey.Flags&dns.SEP == dns.SEP {
+			key.Role = KSK
+		}
+		if st, ok := states[key.Tag]; ok {
+			key.PublishedAt, key.ActiveAt, key.RetiredAt = st.PublishedAt, st.ActiveAt, st.RetiredAt
+			key.State = stateAt(st, time.Now().UTC())
+		}
+		keys = append(keys, key)
+	}
+
+	k.mu.Lock()
+	k.keys = keys
+	k.mu.Unlock()
+	return nil
+}
+
+func loadRolloverStates(file string) (map[uint16]rolloverState, error) {
+	states := map[uint16]rolloverState{}
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return states, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	byTag := map[string]rolloverState{}
+	if err := json.NewDecoder(f).Decode(&byTag); err != nil {
+		return nil, err
+	}
+	for tag, st := range byTag {
+		// the sidecar file uses the decimal key tag as the JSON object key,
+		// since JSON object keys must be strings
+		t, err := strconv.ParseUint(tag, 10, 16)
+		if err != nil {
+			continue
+		}
+		states[uint16(t)] = st
+	}
+	return states, nil
+}
+
+// stateAt returns the rollover state a key is in at instant now, given its
+// publish/active/retire timestamps. A zero timestamp means "not yet
+// scheduled", so it never triggers a transition.
+func stateAt(st rolloverState, now time.Time) KeyState {
+	switch {
+	case !st.RetiredAt.IsZero() && !now.Before(st.RetiredAt):
+		return Retired
+	case !st.ActiveAt.IsZero() && !now.Before(st.ActiveAt):
+		return Active
+	case !st.PublishedAt.IsZero() && !now.Before(st.PublishedAt):
+		return Published
+	default:
+		return Active
+	}
+}
+
+// Advance re-evaluates every key's rollover state against now, driving the
+// published -> active -> retired transitions staged in the sidecar file.
+// Called periodically by WatchRollover so a key scheduled to go active (or
+// retire) takes effect on its own, instead of only at the next LoadKeyDir.
+func (k *KeyRing) Advance(now time.Time) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for _, key := range k.keys {
+		key.State = stateAt(rolloverState{key.PublishedAt, key.ActiveAt, key.RetiredAt}, now)
+	}
+}
+
+// WatchRollover calls Advance on interval for the lifetime of the process,
+// so operators can stage a rollover's timestamps once and have skydns carry
+// out the double-signature / double-DS transitions unattended. It is meant
+// to be run in its own goroutine, alongside Server.refresh.
+func (k *KeyRing) WatchRollover(interval time.Duration) {
+	for range time.Tick(interval) {
+		k.Advance(time.Now().UTC())
+	}
+}
+
+// ZSKs returns the zone signing keys currently in the Active state.
+func (k *KeyRing) ZSKs() []*Key { return k.withRole(ZSK) }
+
+// KSKs returns the key signing keys currently in the Active state.
+func (k *KeyRing) KSKs() []*Key { return k.withRole(KSK) }
+
+func (k *KeyRing) withRole(role KeyRole) []*Key {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	out := make([]*Key, 0, len(k.keys))
+	for _, key := range k.keys {
+		if key.Role == role && key.State == Active {
+			out = append(out, key)
+		}
+	}
+	return out
+}
+
+// ByTag returns the key with the given key tag, or nil if the ring holds
+// no such key. Used by the signature cache's background refresher to find
+// the private key for a cached entry without re-walking the whole ring.
+func (k *KeyRing) ByTag(tag uint16) *Key {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	for _, key := range k.keys {
+		if key.Tag == tag {
+			return key
+		}
+	}
+	return nil
+}
+
+// All returns every key in the ring (published, active or retired), which
+// is what DNSKEY RRset generation needs to publish.
+func (k *KeyRing) All() []*Key {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	out := make([]*Key, len(k.keys))
+	copy(out, k.keys)
+	return out
+}
+
+// Algorithms returns the set of DNSKEY algorithms present among the keys
+// currently known to the ring, used by sign to select the active ZSKs whose
+// algorithm appears in the zone's DNSKEY RRset.
+func (k *KeyRing) Algorithms() map[uint8]bool {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	algos := make(map[uint8]bool)
+	for _, key := range k.keys {
+		algos[key.Dnskey.Algorithm] = true
+	}
+	return algos
+}
@@ -0,0 +1,99 @@
+// Copyright (c) 2013 Erik St. Martin, Brian Ketelsen. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics for the signing, signature cache and denial-of-existence
+// subsystems in dnssec.go. They are registered with the default Prometheus
+// registry on package initialization so operators can alert on signing
+// latency spikes, cache thrash or a runaway denial list.
+var (
+	sigCacheHit = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "skydns",
+		Subsystem: "dnssec",
+		Name:      "signature_cache_hit_total",
+		Help:      "Counter of RRSIG cache hits, per rrtype.",
+	}, []string{"rrtype"})
+
+	sigCacheMiss = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "skydns",
+		Subsystem: "dnssec",
+		Name:      "signature_cache_miss_total",
+		Help:      "Counter of RRSIG cache misses, per rrtype.",
+	}, []string{"rrtype"})
+
+	sigCacheSize = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "skydns",
+		Subsystem: "dnssec",
+		Name:      "signature_cache_size",
+		Help:      "Number of RRSIGs currently held in the signature cache.",
+	})
+
+	sigInflightDup = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "skydns",
+		Subsystem: "dnssec",
+		Name:      "signature_inflight_duplicate_total",
+		Help:      "Counter of signing requests coalesced onto an inflight signing call.",
+	})
+
+	signLatency = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "skydns",
+		Subsystem: "dnssec",
+		Name:      "sign_latency_seconds",
+		Help:      "Histogram of the time it took to produce an RRSIG.",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	denialListSize = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "skydns",
+		Subsystem: "dnssec",
+		Name:      "denial_list_size",
+		Help:      "Number of names held in the denial-of-existence list, per label depth.",
+	}, []string{"depth"})
+
+	nsecSynthesized = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "skydns",
+		Subsystem: "dnssec",
+		Name:      "nsec_synthesized_total",
+		Help:      "Counter of NSEC records synthesized for a reply.",
+	})
+
+	nsec3Synthesized = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "skydns",
+		Subsystem: "dnssec",
+		Name:      "nsec3_synthesized_total",
+		Help:      "Counter of NSEC3 records synthesized for a reply.",
+	})
+
+	sigCacheEvictions = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "skydns",
+		Subsystem: "dnssec",
+		Name:      "signature_cache_eviction_total",
+		Help:      "Counter of signatures evicted from the cache for being least recently used.",
+	})
+
+	sigCacheRefreshes = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "skydns",
+		Subsystem: "dnssec",
+		Name:      "signature_cache_refresh_total",
+		Help:      "Counter of signatures pre-emptively re-signed before expiration by the background refresher.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(sigCacheHit, sigCacheMiss, sigCacheSize, sigInflightDup,
+		signLatency, denialListSize, nsecSynthesized, nsec3Synthesized,
+		sigCacheEvictions, sigCacheRefreshes)
+}
+
+// metricsHandler wires up the Prometheus /metrics endpoint on s's HTTP
+// server, alongside the existing skydns HTTP API.
+func (s *Server) metricsHandler() {
+	s.mux.Handle("/metrics", promhttp.Handler())
+}
@@ -0,0 +1,88 @@
+// Copyright (c) 2013 Erik St. Martin, Brian Ketelsen. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"errors"
+	"github.com/miekg/dns"
+	"github.com/skynetservices/skydns/msg"
+	"strconv"
+	"strings"
+)
+
+// ServeDNSTLSA answers a TLSA query (RFC 6698) for the owner name
+// "_port._proto.name...skydns.local", returning the TLSA records of every
+// service registered under "name...skydns.local" that publishes one and
+// has that port. Only the "_tcp" protocol label matches; a "_udp" query
+// never gets a TLSA answer. Unmatched queries get NXDOMAIN (or NODATA, if the
+// service exists but none of its registrations publish a TLSA record): the
+// zone SOA is added to the authority section and s.nsec synthesizes the
+// covering or matching denial record, same as the normal query path.
+func (s *Server) ServeDNSTLSA(w dns.ResponseWriter, req *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.Authoritative = true
+	m.Compress = false
+
+	q := req.Question[0]
+	port, proto, name, err := splitTLSAOwner(q.Name)
+	if err != nil {
+		m.SetRcode(req, dns.RcodeFormatError)
+		w.WriteMsg(m)
+		return
+	}
+
+	services, err := s.Backend.Records(name)
+	if err != nil {
+		m.SetRcode(req, dns.RcodeServerFailure)
+		w.WriteMsg(m)
+		return
+	}
+
+	for _, svc := range services {
+		if svc.TLSA == nil || proto != "tcp" || strconv.Itoa(int(svc.Port)) != port {
+			continue
+		}
+		m.Answer = append(m.Answer, newTLSA(svc, q.Name))
+	}
+
+	if len(m.Answer) == 0 {
+		if len(services) == 0 {
+			m.SetRcode(req, dns.RcodeNameError)
+		}
+		m.Ns = append(m.Ns, s.soa())
+		s.nsec(m)
+	}
+
+	s.sign(m, dns.DefaultMsgSize)
+	w.WriteMsg(m)
+}
+
+// newTLSA builds the TLSA record owner publishes for svc, from the
+// usage/selector/matching-type/certificate-association-data svc.TLSA holds.
+func newTLSA(svc msg.Service, owner string) *dns.TLSA {
+	return &dns.TLSA{
+		Hdr:          dns.RR_Header{Name: owner, Rrtype: dns.TypeTLSA, Class: dns.ClassINET, Ttl: svc.Ttl},
+		Usage:        svc.TLSA.Usage,
+		Selector:     svc.TLSA.Selector,
+		MatchingType: svc.TLSA.MatchingType,
+		Certificate:  svc.TLSA.Certificate,
+	}
+}
+
+// splitTLSAOwner splits a TLSA owner name of the form "_port._proto.name"
+// into the port, the protocol ("tcp" or "udp") and the remaining service
+// name, as RFC 6698 section 3 requires.
+func splitTLSAOwner(owner string) (port, proto, name string, err error) {
+	labels := dns.SplitDomainName(owner)
+	if len(labels) < 3 {
+		return "", "", "", errors.New("skydns: TLSA owner name too short: " + owner)
+	}
+	portLabel, protoLabel := labels[0], labels[1]
+	if !strings.HasPrefix(portLabel, "_") || !strings.HasPrefix(protoLabel, "_") {
+		return "", "", "", errors.New("skydns: malformed TLSA owner name: " + owner)
+	}
+	return strings.TrimPrefix(portLabel, "_"), strings.TrimPrefix(protoLabel, "_"), dns.Fqdn(strings.Join(labels[2:], ".")), nil
+}
@@ -0,0 +1,368 @@
+// Copyright (c) 2013 Erik St. Martin, Brian Ketelsen. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"bufio"
+	"errors"
+	"github.com/miekg/dns"
+	"github.com/skynetservices/skydns/msg"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Backend is the subset of the service registry that the dynamic update
+// handler needs: look up the services backing a name (to evaluate
+// prerequisites and to find what an UPDATE's delete directives should
+// remove), and add or remove a single service.
+type Backend interface {
+	Records(name string) ([]msg.Service, error)
+	AddService(name string, s msg.Service) error
+	RemoveService(name string) error
+}
+
+// updateMu serializes UPDATE processing so a prerequisite check and the
+// updates that depend on it happen atomically, as RFC 2136 section 3.4
+// requires.
+var updateMu sync.Mutex
+
+// ServeDNSUpdate answers a DNS UPDATE (opcode 5) message, translating
+// ADD/DELETE of A/AAAA/SRV/TXT records into msg.Service create/delete
+// operations against s.Backend, and keeping the denial-of-existence lists
+// in sync. The update is authenticated with TSIG; unsigned or incorrectly
+// signed updates are rejected with NotAuth.
+func (s *Server) ServeDNSUpdate(w dns.ResponseWriter, req *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.Compress = false
+	m.Authoritative = true
+
+	if len(req.Question) != 1 {
+		m.SetRcode(req, dns.RcodeFormatError)
+		w.WriteMsg(m)
+		return
+	}
+
+	if !s.verifyTSIG(req, w) {
+		m.SetRcode(req, dns.RcodeNotAuth)
+		w.WriteMsg(m)
+		return
+	}
+
+	zone := req.Question[0].Name
+
+	updateMu.Lock()
+	defer updateMu.Unlock()
+
+	if rcode := s.checkPrerequisites(req.Answer); rcode != dns.RcodeSuccess {
+		m.SetRcode(req, rcode)
+		s.signTsig(req, m)
+		w.WriteMsg(m)
+		return
+	}
+
+	for _, rr := range req.Ns {
+		if err := s.applyUpdate(zone, rr); err != nil {
+			log.Printf("skydns: dynamic update of %s failed: %s", rr.Header().Name, err)
+			m.SetRcode(req, dns.RcodeServerFailure)
+			s.signTsig(req, m)
+			w.WriteMsg(m)
+			return
+		}
+	}
+
+	m.SetRcode(req, dns.RcodeSuccess)
+	s.signTsig(req, m)
+	w.WriteMsg(m)
+}
+
+// signTsig adds a TSIG RR to m when req carried one, so nsupdate and the
+// Terraform dns provider - which already expect an authenticated reply to an
+// authenticated request - can verify the response came from the key they
+// signed with. The ResponseWriter signs the wire message against that RR
+// using s's TsigSecret when m is written.
+func (s *Server) signTsig(req, m *dns.Msg) {
+	t := req.IsTsig()
+	if t == nil {
+		return
+	}
+	m.SetTsig(t.Hdr.Name, t.Algorithm, t.Fudge, time.Now().Unix())
+}
+
+// verifyTSIG reports whether req carries a TSIG signature that validates
+// against s.TsigSecret. Requests without a TSIG are rejected, as skydns has
+// no other way to authenticate an UPDATE.
+func (s *Server) verifyTSIG(req *dns.Msg, w dns.ResponseWriter) bool {
+	if req.IsTsig() == nil {
+		return false
+	}
+	return w.TsigStatus() == nil
+}
+
+// checkPrerequisites evaluates the prerequisite section of an UPDATE
+// (RFC 2136 section 2.4 / 3.2) against the current service registry.
+func (s *Server) checkPrerequisites(prereqs []dns.RR) int {
+	for _, rr := range prereqs {
+		h := rr.Header()
+		services, err := s.Backend.Records(h.Name)
+		if err != nil {
+			return dns.RcodeServerFailure
+		}
+		switch h.Class {
+		case dns.ClassANY:
+			if h.Rrtype == dns.TypeANY {
+				// Name is in use.
+				if len(services) == 0 {
+					return dns.RcodeNameError
+				}
+				continue
+			}
+			// RRset exists (value independent).
+			if !anyServiceHasType(services, h.Rrtype) {
+				return dns.RcodeNXRrset
+			}
+		case dns.ClassNONE:
+			if h.Rrtype == dns.TypeANY {
+				// Name is not in use.
+				if len(services) != 0 {
+					return dns.RcodeYXDomain
+				}
+				continue
+			}
+			// RRset does not exist.
+			if anyServiceHasType(services, h.Rrtype) {
+				return dns.RcodeYXRrset
+			}
+		default:
+			// RRset exists (value dependent); the prerequisite RR itself
+			// carries the rdata that must be present.
+			if !anyServiceMatches(services, rr) {
+				return dns.RcodeNXRrset
+			}
+		}
+	}
+	return dns.RcodeSuccess
+}
+
+// applyUpdate applies a single RR from an UPDATE's authority section,
+// translating it into a service registry mutation and keeping the denial
+// lists consistent with addServiceNSEC/removeServiceNSEC.
+func (s *Server) applyUpdate(zone string, rr dns.RR) error {
+	h := rr.Header()
+	if !dns.IsSubDomain(zone, h.Name) {
+		return errors.New("skydns: " + h.Name + " is not in zone " + zone)
+	}
+
+	if h.Class == dns.ClassNONE {
+		// Delete an RR from an RRset (RFC 2136 section 2.5.4): the RR
+		// carries the exact rdata to remove, every other registration at
+		// the name is untouched.
+		return s.deleteRR(h.Name, rr)
+	}
+	if h.Class == dns.ClassANY && h.Rdlength == 0 {
+		if h.Rrtype == dns.TypeANY {
+			// Delete all RRsets from a name (RFC 2136 section 2.5.2).
+			return s.deleteService(h.Name)
+		}
+		// Delete an RRset (RFC 2136 section 2.5.3): only the registrations
+		// of h.Rrtype at the name are removed.
+		return s.deleteRRset(h.Name, h.Rrtype)
+	}
+
+	svc, err := serviceFromRR(rr)
+	if err != nil {
+		return err
+	}
+	svc.Region, svc.Version, svc.Name, svc.Environment = serviceNameFromOwner(zone, h.Name)
+	if err := s.Backend.AddService(h.Name, svc); err != nil {
+		return err
+	}
+	addServiceNSEC(svc)
+	return nil
+}
+
+// serviceNameFromOwner splits the labels of owner that precede zone into the
+// up to four msg.Service name components the denial-of-existence subsystem
+// keys on (see the "east.1-0-0.web.production" example in dnssec.go):
+// region, version, name and environment, most specific first. Fewer than
+// four labels fill in from the right, so "web.production" is Name/Environment
+// only, and "production" is Environment only.
+func serviceNameFromOwner(zone, owner string) (region, version, name, environment string) {
+	labels := dns.SplitDomainName(owner)
+	zoneLabels := dns.SplitDomainName(zone)
+	if len(labels) > len(zoneLabels) {
+		labels = labels[:len(labels)-len(zoneLabels)]
+	} else {
+		labels = nil
+	}
+	if len(labels) > 4 {
+		labels = labels[len(labels)-4:]
+	}
+	switch len(labels) {
+	case 4:
+		return labels[0], labels[1], labels[2], labels[3]
+	case 3:
+		return "", labels[0], labels[1], labels[2]
+	case 2:
+		return "", "", labels[0], labels[1]
+	case 1:
+		return "", "", "", labels[0]
+	}
+	return "", "", "", ""
+}
+
+func (s *Server) deleteService(name string) error {
+	services, err := s.Backend.Records(name)
+	if err != nil {
+		return err
+	}
+	for _, svc := range services {
+		removeServiceNSEC(svc)
+	}
+	return s.Backend.RemoveService(name)
+}
+
+// deleteRRset removes every service at name that would answer rrtype,
+// leaving services of other types registered at the same name untouched.
+func (s *Server) deleteRRset(name string, rrtype uint16) error {
+	services, err := s.Backend.Records(name)
+	if err != nil {
+		return err
+	}
+	keep := make([]msg.Service, 0, len(services))
+	for _, svc := range services {
+		if serviceHasType(svc, rrtype) {
+			removeServiceNSEC(svc)
+			continue
+		}
+		keep = append(keep, svc)
+	}
+	return s.replaceServices(name, keep)
+}
+
+// deleteRR removes every service at name whose rdata matches rr, leaving
+// every other registration at the name untouched.
+func (s *Server) deleteRR(name string, rr dns.RR) error {
+	services, err := s.Backend.Records(name)
+	if err != nil {
+		return err
+	}
+	want, err := serviceFromRR(rr)
+	if err != nil {
+		return err
+	}
+	keep := make([]msg.Service, 0, len(services))
+	for _, svc := range services {
+		if svc.Host == want.Host && svc.Port == want.Port && svc.Text == want.Text {
+			removeServiceNSEC(svc)
+			continue
+		}
+		keep = append(keep, svc)
+	}
+	return s.replaceServices(name, keep)
+}
+
+// replaceServices removes every service currently registered at name and
+// re-adds those in keep. The Backend has no primitive for removing a single
+// registration without touching its siblings at the same name, so a partial
+// delete goes through a full remove-then-readd.
+func (s *Server) replaceServices(name string, keep []msg.Service) error {
+	if err := s.Backend.RemoveService(name); err != nil {
+		return err
+	}
+	for _, svc := range keep {
+		if err := s.Backend.AddService(name, svc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// serviceFromRR builds the msg.Service a skydns record for rr's owner name
+// would need to hold, for the record types nsupdate and Terraform's dns
+// provider commonly send.
+func serviceFromRR(rr dns.RR) (msg.Service, error) {
+	svc := msg.Service{Ttl: uint32(rr.Header().Ttl)}
+	switch t := rr.(type) {
+	case *dns.A:
+		svc.Host = t.A.String()
+	case *dns.AAAA:
+		svc.Host = t.AAAA.String()
+	case *dns.SRV:
+		svc.Host = strings.TrimSuffix(t.Target, ".")
+		svc.Port = t.Port
+		svc.Priority = t.Priority
+		svc.Weight = t.Weight
+	case *dns.TXT:
+		svc.Text = strings.Join(t.Txt, "")
+	default:
+		return svc, errors.New("skydns: unsupported record type in dynamic update: " + dns.TypeToString[rr.Header().Rrtype])
+	}
+	return svc, nil
+}
+
+func anyServiceHasType(services []msg.Service, rrtype uint16) bool {
+	for _, s := range services {
+		if serviceHasType(s, rrtype) {
+			return true
+		}
+	}
+	return false
+}
+
+// serviceHasType reports whether s holds the fields needed to answer rrtype.
+func serviceHasType(s msg.Service, rrtype uint16) bool {
+	switch rrtype {
+	case dns.TypeA, dns.TypeAAAA:
+		return s.Host != ""
+	case dns.TypeSRV:
+		return s.Port != 0
+	case dns.TypeTXT:
+		return s.Text != ""
+	}
+	return false
+}
+
+func anyServiceMatches(services []msg.Service, rr dns.RR) bool {
+	want, err := serviceFromRR(rr)
+	if err != nil {
+		return false
+	}
+	for _, s := range services {
+		if s.Host == want.Host && s.Port == want.Port && s.Text == want.Text {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadTSIGKeys reads a "name secret" per line key file into a TsigSecret
+// map suitable for s.TsigSecret and the underlying dns.Server, which
+// expects HMAC-SHA256 keys as "name." -> base64(secret) entries.
+func LoadTSIGKeys(file string) (map[string]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	keys := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, errors.New("skydns: malformed TSIG key line: " + line)
+		}
+		keys[dns.Fqdn(fields[0])] = fields[1]
+	}
+	return keys, scanner.Err()
+}